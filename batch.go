@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BatchOp is a single write in a batch or transaction request.
+type BatchOp struct {
+	Op     string          `json:"op"`
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// Step statuses reported by the batch endpoint.
+const (
+	stepApplied            = "applied"
+	stepFailed             = "failed"
+	stepSkipped            = "skipped"
+	stepCompensated        = "compensated"
+	stepCompensationFailed = "compensation_failed"
+)
+
+// BatchStep reports what happened to one operation of a batch.
+type BatchStep struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (op *BatchOp) validate() error {
+	if op.Bucket == "" {
+		op.Bucket = "items"
+	}
+	if err := checkBucketName(op.Bucket); err != nil {
+		return err
+	}
+	if op.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+
+	switch op.Op {
+	case opPut:
+		if len(op.Value) == 0 {
+			return fmt.Errorf("value is required for put")
+		}
+	case opDelete:
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	return nil
+}
+
+// apply runs the operation inside tx and returns the value the key had
+// before, for compensation.
+func (op *BatchOp) apply(tx *bolt.Tx) (prev []byte, err error) {
+	if b := tx.Bucket([]byte(op.Bucket)); b != nil {
+		v, err := getValue(b, []byte(op.Key))
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			prev = append([]byte(nil), v...)
+		}
+	}
+
+	if op.Op == opPut {
+		return prev, putRecord(tx, op.Bucket, []byte(op.Key), op.Value)
+	}
+	return prev, deleteRecord(tx, op.Bucket, []byte(op.Key))
+}
+
+// compensate restores the value a key had before an applied operation. It
+// bypasses state machines and invariants, since it returns to a state that
+// already passed them.
+func (op *BatchOp) compensate(tx *bolt.Tx, prev []byte) error {
+	key := []byte(op.Key)
+
+	if prev == nil {
+		if b := tx.Bucket([]byte(op.Bucket)); b == nil || b.Get(key) == nil {
+			return nil
+		}
+		return deleteLogged(tx, op.Bucket, key)
+	}
+
+	if err := putLogged(tx, op.Bucket, key, prev); err != nil {
+		return err
+	}
+	// Undoing an item deletion also takes the item back out of the trash
+	if op.Op == opDelete && op.Bucket == "items" && tx.Bucket([]byte("trash")).Get(key) != nil {
+		return deleteLogged(tx, "trash", key)
+	}
+	return nil
+}
+
+// runBatch executes ops one transaction at a time. If an operation fails and
+// compensate is set, the operations applied before it are undone in reverse
+// order. It reports whether every operation was applied.
+func runBatch(ops []BatchOp, compensate bool) ([]BatchStep, bool) {
+	steps := make([]BatchStep, len(ops))
+	prevs := make([][]byte, len(ops))
+	for i, op := range ops {
+		steps[i] = BatchStep{Index: i, Op: op.Op, Bucket: op.Bucket, Key: op.Key, Status: stepSkipped}
+	}
+
+	failed := -1
+	for i := range ops {
+		err := db.Update(func(tx *bolt.Tx) error {
+			var err error
+			prevs[i], err = ops[i].apply(tx)
+			return err
+		})
+		if err != nil {
+			steps[i].Status = stepFailed
+			steps[i].Error = err.Error()
+			failed = i
+			break
+		}
+		steps[i].Status = stepApplied
+	}
+	if failed < 0 {
+		return steps, true
+	}
+	if !compensate {
+		return steps, false
+	}
+
+	for i := failed - 1; i >= 0; i-- {
+		err := db.Update(func(tx *bolt.Tx) error {
+			return ops[i].compensate(tx, prevs[i])
+		})
+		if err != nil {
+			steps[i].Status = stepCompensationFailed
+			steps[i].Error = err.Error()
+			log.Println("Error compensating batch step", i, "on", ops[i].Bucket+"/"+ops[i].Key+":", err)
+			continue
+		}
+		steps[i].Status = stepCompensated
+	}
+	return steps, false
+}
+
+// batchWrite applies a list of operations without atomicity: each operation
+// commits on its own. With ?compensate=true a failure undoes the operations
+// that were already applied, saga style.
+func batchWrite(w http.ResponseWriter, r *http.Request) {
+	var ops []BatchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println("Error decoding JSON:", err)
+		return
+	}
+	for i := range ops {
+		if err := ops[i].validate(); err != nil {
+			http.Error(w, fmt.Sprintf("operation %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	compensate := r.URL.Query().Get("compensate") == "true"
+	steps, ok := runBatch(ops, compensate)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(struct {
+		OK    bool        `json:"ok"`
+		Steps []BatchStep `json:"steps"`
+	}{ok, steps})
+
+	log.Println("Batch of", len(ops), "operations finished, ok:", ok)
+}
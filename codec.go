@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Stored values may be prefixed with a magic byte naming their encoding.
+// Plain JSON values carry no prefix, which keeps values written before
+// compression or encryption was enabled readable as they are.
+const (
+	magicGzip   byte = 0x01
+	magicAESGCM byte = 0x02
+)
+
+// compressThresholds maps bucket names to the value size above which values
+// written to the bucket are gzip-compressed.
+var compressThresholds = map[string]int{}
+
+// compressFlag parses -compress values of the form bucket:threshold.
+type compressFlag struct{}
+
+func (compressFlag) String() string { return "" }
+
+func (compressFlag) Set(s string) error {
+	for _, spec := range strings.Split(s, ",") {
+		bucket, threshold, ok := strings.Cut(spec, ":")
+		if !ok {
+			return fmt.Errorf("expected bucket:threshold, got %q", spec)
+		}
+		n, err := strconv.Atoi(threshold)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid threshold %q", threshold)
+		}
+		compressThresholds[bucket] = n
+	}
+	return nil
+}
+
+// encodeValue returns the stored form of a value written to bucket: the value
+// is compressed first, if configured for the bucket, then encrypted, if a key
+// is configured.
+func encodeValue(bucket string, v []byte) ([]byte, error) {
+	v, err := compressValue(bucket, v)
+	if err != nil {
+		return nil, err
+	}
+	return encryptValue(v)
+}
+
+func compressValue(bucket string, v []byte) ([]byte, error) {
+	threshold, ok := compressThresholds[bucket]
+	if !ok || len(v) <= threshold {
+		return v, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(magicGzip)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(v); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	// Not worth it if compression does not actually save space
+	if buf.Len() >= len(v) {
+		return v, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeValue returns the plain form of a stored value.
+func decodeValue(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return v, nil
+	}
+
+	switch v[0] {
+	case magicAESGCM:
+		inner, _, err := decryptValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return decodeValue(inner)
+	case magicGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(v[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	default:
+		return v, nil
+	}
+}
+
+// needsRecode reports whether a stored value differs from the form
+// encodeValue would give it now, ignoring the random encryption nonce.
+func needsRecode(bucket string, stored, plain []byte) (bool, error) {
+	inner, keyID := stored, ""
+	if len(stored) > 0 && stored[0] == magicAESGCM {
+		var err error
+		if inner, keyID, err = decryptValue(stored); err != nil {
+			return false, err
+		}
+	}
+	if keyID != encryptionKeys.current {
+		return true, nil
+	}
+
+	want, err := compressValue(bucket, plain)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(inner, want), nil
+}
+
+// getValue returns the plain value of key in b, or nil if it does not exist.
+func getValue(b *bolt.Bucket, key []byte) ([]byte, error) {
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+	return decodeValue(v)
+}
+
+// recodeBatchSize is how many keys a recode pass rewrites per transaction.
+const recodeBatchSize = 1000
+
+// recodeBucket rewrites every value of bucket whose stored form differs from
+// what encodeValue produces now, in chunked transactions. It migrates existing
+// values after compression settings change and re-encrypts them with the
+// current key after a key rotation.
+func recodeBucket(bucket string) (int, error) {
+	var n int
+	var after []byte
+	for {
+		done := true
+		err := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return nil
+			}
+
+			c := b.Cursor()
+			k, v := c.First()
+			if after != nil {
+				if k, v = c.Seek(after); k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+
+			// Collect the chunk first; writing while iterating would
+			// invalidate the cursor
+			type kv struct{ k, v []byte }
+			var chunk []kv
+			for ; k != nil && len(chunk) < recodeBatchSize; k, v = c.Next() {
+				if v == nil {
+					continue // nested bucket
+				}
+				chunk = append(chunk, kv{append([]byte(nil), k...), append([]byte(nil), v...)})
+			}
+			if k != nil {
+				done = false
+			}
+
+			for _, e := range chunk {
+				plain, err := decodeValue(e.v)
+				if err != nil {
+					return fmt.Errorf("key %q: %w", e.k, err)
+				}
+				recode, err := needsRecode(bucket, e.v, plain)
+				if err != nil {
+					return fmt.Errorf("key %q: %w", e.k, err)
+				}
+				if recode {
+					if err := putLogged(tx, bucket, e.k, plain); err != nil {
+						return err
+					}
+					n++
+				}
+				after = e.k
+			}
+			return nil
+		})
+		if err != nil || done {
+			return n, err
+		}
+	}
+}
+
+// recode migrates the stored values of a bucket to its current encoding.
+func recode(w http.ResponseWriter, r *http.Request) {
+	bucket := mux.Vars(r)["bucket"]
+
+	n, err := recodeBucket(bucket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println("Error recoding bucket", bucket+":", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"rewritten\":%d}\n", n)
+	log.Println("Recoded", n, "values in bucket", bucket)
+}
+
+// reencrypt recodes every bucket holding records, which re-encrypts their
+// values with the current key after a rotation.
+func reencrypt(w http.ResponseWriter, r *http.Request) {
+	var buckets []string
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if string(name) != "changes" {
+				buckets = append(buckets, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println("Error listing buckets:", err)
+		return
+	}
+
+	rewritten := map[string]int{}
+	for _, bucket := range buckets {
+		n, err := recodeBucket(bucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Error re-encrypting bucket", bucket+":", err)
+			return
+		}
+		rewritten[bucket] = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"key": encryptionKeys.current, "rewritten": rewritten})
+	log.Println("Re-encrypted values with key", encryptionKeys.current+":", rewritten)
+}
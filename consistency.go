@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Reads may carry the sequence number of a change they need to observe, taken
+// from the X-Seq header of an earlier response, either as an X-Min-Seq header
+// or a min_seq query parameter. Writes also hand out an X-Session-Token that
+// encodes the sequence number of the commit; presenting it on later reads
+// gives read-your-writes semantics without tracking sequence numbers.
+// Followers that have not caught up wait for up to consistencyWait and then
+// proxy the read to the leader.
+var consistencyWait = 500 * time.Millisecond
+
+// leaderProxy forwards reads a follower is too stale to serve. It is nil on
+// leaders.
+var leaderProxy atomic.Pointer[httputil.ReverseProxy]
+
+func setLeader(leader string) error {
+	u, err := url.Parse(leader)
+	if err != nil {
+		return err
+	}
+	leaderProxy.Store(httputil.NewSingleHostReverseProxy(u))
+	return nil
+}
+
+func currentSeq() uint64 {
+	var seq uint64
+	db.View(func(tx *bolt.Tx) error {
+		seq = lastSeq(tx)
+		return nil
+	})
+	return seq
+}
+
+// sessionTokenPrefix versions the session token format.
+const sessionTokenPrefix = "s1."
+
+func encodeSessionToken(seq uint64) string {
+	return sessionTokenPrefix + base64.RawURLEncoding.EncodeToString(itob(seq))
+}
+
+func decodeSessionToken(token string) (uint64, error) {
+	if len(token) <= len(sessionTokenPrefix) || token[:len(sessionTokenPrefix)] != sessionTokenPrefix {
+		return 0, errors.New("unknown session token format")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token[len(sessionTokenPrefix):])
+	if err != nil || len(b) != 8 {
+		return 0, errors.New("malformed session token")
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// minSeq returns the highest sequence number the request asks to observe,
+// from its min-seq hint and session token.
+func minSeq(r *http.Request) (uint64, error) {
+	var seq uint64
+
+	s := r.Header.Get("X-Min-Seq")
+	if s == "" {
+		s = r.URL.Query().Get("min_seq")
+	}
+	if s != "" {
+		var err error
+		if seq, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+
+	if token := r.Header.Get("X-Session-Token"); token != "" {
+		tseq, err := decodeSessionToken(token)
+		if err != nil {
+			return 0, err
+		}
+		seq = max(seq, tseq)
+	}
+	return seq, nil
+}
+
+// waitForSeq waits until the local change log reaches seq or the timeout
+// expires, and reports whether it did.
+func waitForSeq(seq uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for currentSeq() < seq {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// consistency enforces min-sequence hints on follower reads and reports the
+// sequence number a response reflects in its X-Seq header.
+func consistency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seq, err := minSeq(r)
+		if err != nil {
+			http.Error(w, "invalid consistency hint: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		isRead := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if proxy := leaderProxy.Load(); isRead && proxy != nil && seq > 0 && !waitForSeq(seq, consistencyWait) {
+			log.Println("Proxying", r.Method, r.URL.Path, "to leader for seq", seq)
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &seqWriter{ResponseWriter: w, session: !isRead}
+		if isRead {
+			// Reads may write their response while their own read
+			// transaction is open, and a nested transaction can
+			// deadlock against a writer remapping the file, so the
+			// sequence is taken up front. Whatever the read observes
+			// is at least this fresh.
+			sw.setSeq()
+		}
+		next.ServeHTTP(sw, r)
+		sw.setSeq()
+	})
+}
+
+// seqWriter sets the X-Seq header, and the X-Session-Token header for
+// writes, right before the response headers are sent, so writes report a
+// sequence number that includes their own change. Write handlers must
+// therefore only respond after their transactions have ended.
+type seqWriter struct {
+	http.ResponseWriter
+	session bool
+	done    bool
+}
+
+func (w *seqWriter) setSeq() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	seq := currentSeq()
+	w.Header().Set("X-Seq", strconv.FormatUint(seq, 10))
+	if w.session {
+		w.Header().Set("X-Session-Token", encodeSessionToken(seq))
+	}
+}
+
+func (w *seqWriter) WriteHeader(code int) {
+	w.setSeq()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *seqWriter) Write(p []byte) (int, error) {
+	w.setSeq()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *seqWriter) Flush() {
+	w.setSeq()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// keyring holds the AES keys values may be encrypted with. New values are
+// encrypted with the current key; retired keys stay in the ring so values
+// and change-log entries written with them remain readable until they have
+// been re-encrypted or compacted away.
+type keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+var encryptionKeys keyring
+
+// keyFile is the format of the -keys-file file. Keys are base64-encoded and
+// must be 16, 24 or 32 bytes long.
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// loadKeys reads the encryption keys from path, or from the
+// ITEMS_ENCRYPTION_KEY environment variable (key ID "env") if path is empty.
+func loadKeys(path string) error {
+	var kf keyFile
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &kf); err != nil {
+			return err
+		}
+	} else if key := os.Getenv("ITEMS_ENCRYPTION_KEY"); key != "" {
+		kf = keyFile{Current: "env", Keys: map[string]string{"env": key}}
+	} else {
+		return nil
+	}
+
+	ring := keyring{current: kf.Current, aeads: map[string]cipher.AEAD{}}
+	for id, encoded := range kf.Keys {
+		if len(id) == 0 || len(id) > 255 {
+			return fmt.Errorf("invalid key ID %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", id, err)
+		}
+		if ring.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return fmt.Errorf("key %q: %w", id, err)
+		}
+	}
+	if _, ok := ring.aeads[ring.current]; !ok {
+		return fmt.Errorf("current key %q is not in the key set", ring.current)
+	}
+
+	encryptionKeys = ring
+	return nil
+}
+
+// encryptValue seals v with the current key under a fresh nonce, as
+// magic | key ID length | key ID | nonce | ciphertext. It returns v unchanged
+// when no key is configured.
+func encryptValue(v []byte) ([]byte, error) {
+	if encryptionKeys.current == "" {
+		return v, nil
+	}
+
+	id := encryptionKeys.current
+	aead := encryptionKeys.aeads[id]
+
+	out := make([]byte, 0, 2+len(id)+aead.NonceSize()+len(v)+aead.Overhead())
+	out = append(out, magicAESGCM, byte(len(id)))
+	out = append(out, id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+
+	// The header is authenticated too, so a value can't be moved to
+	// another key ID
+	return aead.Seal(out, nonce, v, out[:2+len(id)]), nil
+}
+
+// decryptValue opens a value sealed by encryptValue and returns it along with
+// the ID of the key it was encrypted with.
+func decryptValue(v []byte) ([]byte, string, error) {
+	if len(v) < 2 || len(v) < 2+int(v[1]) {
+		return nil, "", errors.New("truncated encrypted value")
+	}
+
+	header := v[:2+int(v[1])]
+	id := string(header[2:])
+	aead, ok := encryptionKeys.aeads[id]
+	if !ok {
+		return nil, id, fmt.Errorf("value encrypted with unknown key %q", id)
+	}
+
+	rest := v[len(header):]
+	if len(rest) < aead.NonceSize() {
+		return nil, id, errors.New("truncated encrypted value")
+	}
+
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, id, err
+	}
+	return plain, id, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// instanceInfo is what an instance publishes about itself to service
+// discovery.
+type instanceInfo struct {
+	ID      string `json:"id"`
+	Role    string `json:"role"`
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+}
+
+// registrar publishes the instance to a service-discovery backend.
+// Register is called on startup and again whenever the role changes.
+type registrar interface {
+	Register(info instanceInfo) error
+	Deregister() error
+}
+
+// newRegistrar returns a registrar for a consul:// or etcd:// URL.
+func newRegistrar(target string) (registrar, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	switch u.Scheme {
+	case "consul":
+		return &consulRegistrar{base: "http://" + u.Host, client: client}, nil
+	case "etcd":
+		return &etcdRegistrar{base: "http://" + u.Host, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unsupported discovery backend %q", u.Scheme)
+	}
+}
+
+// currentRole returns the replication role of the instance.
+func currentRole() string {
+	switch {
+	case readOnly:
+		return "read-only"
+	case following.Load():
+		return "follower"
+	default:
+		return "leader"
+	}
+}
+
+// serviceName is the name instances register under.
+const serviceName = "items"
+
+// consulRegistrar registers the instance with the local Consul agent, which
+// health-checks it through /healthz.
+type consulRegistrar struct {
+	base   string
+	client *http.Client
+
+	mu sync.Mutex
+	id string
+}
+
+func (c *consulRegistrar) Register(info instanceInfo) error {
+	u, err := url.Parse(info.Address)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(u.Port())
+
+	c.mu.Lock()
+	c.id = info.ID
+	c.mu.Unlock()
+
+	return c.put("/v1/agent/service/register", map[string]any{
+		"ID":      info.ID,
+		"Name":    serviceName,
+		"Tags":    []string{info.Role},
+		"Address": u.Hostname(),
+		"Port":    port,
+		"Meta":    map[string]string{"role": info.Role},
+		"Check": map[string]any{
+			"HTTP":                           info.Address + "/healthz",
+			"Interval":                       "10s",
+			"DeregisterCriticalServiceAfter": "5m",
+		},
+	})
+}
+
+func (c *consulRegistrar) Deregister() error {
+	c.mu.Lock()
+	id := c.id
+	c.mu.Unlock()
+
+	return c.put("/v1/agent/service/deregister/"+url.PathEscape(id), nil)
+}
+
+func (c *consulRegistrar) put(path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.base+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul returned %s", resp.Status)
+	}
+	return nil
+}
+
+// etcdRegistrar writes the instance under /services/items/<id> in etcd through
+// its JSON gateway, attached to a lease kept alive while the instance runs so
+// the record disappears if the instance dies.
+type etcdRegistrar struct {
+	base   string
+	client *http.Client
+
+	// mu guards the fields below, shared between Register, called on
+	// promotion, and the keepalive loop.
+	mu    sync.Mutex
+	lease string
+	info  instanceInfo
+	stop  chan struct{}
+}
+
+// etcdLeaseTTL is the lifetime in seconds of the lease holding the record.
+const etcdLeaseTTL = 15
+
+func (e *etcdRegistrar) Register(info instanceInfo) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.info = info
+	if e.stop == nil {
+		e.stop = make(chan struct{})
+		go e.keepAlive(e.stop)
+	}
+	if e.lease == "" {
+		return e.grant()
+	}
+	return e.put()
+}
+
+// grant obtains a new lease and writes the record under it. It is called with
+// mu held.
+func (e *etcdRegistrar) grant() error {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := e.post("/v3/lease/grant", map[string]any{"TTL": etcdLeaseTTL}, &grant); err != nil {
+		return err
+	}
+	e.lease = grant.ID
+	return e.put()
+}
+
+// put writes the record under the current lease. It is called with mu held.
+func (e *etcdRegistrar) put() error {
+	value, err := json.Marshal(e.info)
+	if err != nil {
+		return err
+	}
+
+	key := "/services/" + serviceName + "/" + e.info.ID
+	return e.post("/v3/kv/put", map[string]any{
+		"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": e.lease,
+	}, nil)
+}
+
+// keepAlive refreshes the lease, and the health in the record, until stop is
+// closed. If the lease could not be refreshed or has expired, for instance
+// during an etcd outage, a new one is granted and the record written again.
+func (e *etcdRegistrar) keepAlive(stop chan struct{}) {
+	ticker := time.NewTicker(etcdLeaseTTL * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		e.mu.Lock()
+		if err := e.refresh(); err != nil {
+			log.Println("Error refreshing etcd registration:", err)
+		}
+		e.mu.Unlock()
+	}
+}
+
+// refresh is called with mu held.
+func (e *etcdRegistrar) refresh() error {
+	if e.lease == "" {
+		return e.grant()
+	}
+
+	var alive struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	err := e.post("/v3/lease/keepalive", map[string]any{"ID": e.lease}, &alive)
+	if err != nil || alive.Result.TTL == "" || alive.Result.TTL == "0" {
+		// The lease is gone or may expire before the next attempt
+		e.lease = ""
+		return e.grant()
+	}
+
+	if e.info.Healthy != healthy() {
+		e.info.Healthy = healthy()
+		return e.put()
+	}
+	return nil
+}
+
+func (e *etcdRegistrar) Deregister() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+	if e.lease == "" {
+		return nil
+	}
+	lease := e.lease
+	e.lease = ""
+	return e.post("/v3/lease/revoke", map[string]any{"ID": lease}, nil)
+}
+
+func (e *etcdRegistrar) post(path string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.base+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd returned %s", resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// leaderRecord is the service-discovery record naming the current leader,
+// rewritten by a follower when it promotes itself.
+type leaderRecord struct {
+	Leader string    `json:"leader"`
+	Since  time.Time `json:"since"`
+}
+
+// watchLeader checks the leader's /healthz every interval and promotes this
+// follower once the leader has been unhealthy for longer than after. There is
+// no fencing: the old leader must stay down or be demoted by the operator,
+// so run a single follower with failover enabled. It returns after promoting.
+func watchLeader(leader string, after, interval time.Duration, promoted func()) {
+	client := &http.Client{Timeout: interval}
+	lastHealthy := time.Now()
+
+	for range time.Tick(interval) {
+		resp, err := client.Get(leader + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				lastHealthy = time.Now()
+				continue
+			}
+		}
+
+		down := time.Since(lastHealthy)
+		log.Println("Leader", leader, "unhealthy for", down.Round(time.Second))
+		if down > after {
+			following.Store(false)
+			leaderProxy.Store(nil)
+			log.Println("Promoted to leader after", leader, "was unhealthy for", down.Round(time.Second))
+			promoted()
+			return
+		}
+	}
+}
+
+// writeLeaderRecord atomically replaces the discovery record at path.
+func writeLeaderRecord(path, leader string) error {
+	data, err := json.Marshal(leaderRecord{Leader: leader, Since: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
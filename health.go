@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Health checks are served outside the API router and its middleware, and
+// read the result of a background probe instead of opening a transaction
+// per request, so monitoring never queues behind the writer.
+
+type probeResult struct {
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+var lastProbe atomic.Pointer[probeResult]
+
+// runProbes refreshes the cached probe result every interval. It never
+// returns.
+func runProbes(interval time.Duration) {
+	for {
+		probe()
+		time.Sleep(interval)
+	}
+}
+
+func probe() {
+	err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("items")) == nil {
+			return errors.New("bucket 'items' is missing")
+		}
+		return nil
+	})
+
+	result := &probeResult{OK: err == nil, CheckedAt: time.Now().UTC()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	lastProbe.Store(result)
+}
+
+// healthy reports whether the last probe succeeded.
+func healthy() bool {
+	result := lastProbe.Load()
+	return result != nil && result.OK
+}
+
+// healthHandler returns the minimal handler for health endpoints, bypassing
+// the API middleware.
+func healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	return mux
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	result := lastProbe.Load()
+	if result == nil {
+		result = &probeResult{Error: "no probe has completed yet"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !result.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
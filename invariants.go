@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Invariant is a rule spanning several records of a bucket. Check runs inside
+// the write transaction after key has been written or deleted; returning an
+// error rolls the transaction back.
+type Invariant interface {
+	Name() string
+	Check(b *bolt.Bucket, key []byte) error
+}
+
+// invariants holds the registered invariants keyed by bucket name.
+var invariants = map[string][]Invariant{}
+
+func registerInvariant(bucket string, inv Invariant) {
+	invariants[bucket] = append(invariants[bucket], inv)
+}
+
+// loadInvariants reads a JSON file mapping bucket names to sum-limit
+// invariants.
+func loadInvariants(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var decls map[string][]*SumLimit
+	if err := json.Unmarshal(data, &decls); err != nil {
+		return err
+	}
+
+	for bucket, list := range decls {
+		for _, inv := range list {
+			if inv.ParentField == "" || inv.SumField == "" || inv.LimitField == "" {
+				return fmt.Errorf("incomplete invariant %q for bucket %q", inv.Label, bucket)
+			}
+			registerInvariant(bucket, inv)
+		}
+	}
+	return nil
+}
+
+type invariantError struct {
+	Invariant string `json:"invariant"`
+	Detail    string `json:"detail"`
+}
+
+func (e *invariantError) Error() string {
+	return fmt.Sprintf("invariant %q violated: %s", e.Invariant, e.Detail)
+}
+
+// checkInvariants runs every invariant registered for bucket after key was
+// changed.
+func checkInvariants(bucket string, b *bolt.Bucket, key []byte) error {
+	for _, inv := range invariants[bucket] {
+		if err := inv.Check(b, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeInvariantError(w http.ResponseWriter, ierr *invariantError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*invariantError
+	}{ierr.Error(), ierr})
+}
+
+// SumLimit requires the SumField values of all records whose ParentField
+// points at a parent record to add up to at most the parent's LimitField,
+// e.g. the allocations of a parent must not exceed its capacity.
+//
+// Each check scans the whole bucket, which is fine for the collection sizes
+// this PoC targets.
+type SumLimit struct {
+	Label       string `json:"name"`
+	ParentField string `json:"parentField"`
+	SumField    string `json:"sumField"`
+	LimitField  string `json:"limitField"`
+}
+
+func (s *SumLimit) Name() string {
+	if s.Label != "" {
+		return s.Label
+	}
+	return fmt.Sprintf("sum(%s) <= %s.%s", s.SumField, s.ParentField, s.LimitField)
+}
+
+func (s *SumLimit) Check(b *bolt.Bucket, key []byte) error {
+	// A write can affect the group the record belongs to and, when the
+	// record is itself a parent, the group it heads.
+	parents := [][]byte{key}
+	v, err := getValue(b, key)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		parent, err := fieldString(v, s.ParentField)
+		if err != nil {
+			return err
+		}
+		if parent != "" {
+			parents = append(parents, []byte(parent))
+		}
+	}
+
+	for _, parent := range parents {
+		if err := s.checkParent(b, parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SumLimit) checkParent(b *bolt.Bucket, parent []byte) error {
+	v, err := getValue(b, parent)
+	if err != nil || v == nil {
+		return err
+	}
+
+	limit, ok, err := fieldNumber(v, s.LimitField)
+	if err != nil || !ok {
+		return err
+	}
+
+	var sum float64
+	err = b.ForEach(func(k, v []byte) error {
+		v, err := decodeValue(v)
+		if err != nil {
+			return err
+		}
+
+		p, err := fieldString(v, s.ParentField)
+		if err != nil || !bytes.Equal([]byte(p), parent) {
+			return err
+		}
+
+		n, _, err := fieldNumber(v, s.SumField)
+		sum += n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if sum > limit {
+		return &invariantError{
+			Invariant: s.Name(),
+			Detail:    fmt.Sprintf("%s of %q is %g, exceeding %s %g", s.SumField, parent, sum, s.LimitField, limit),
+		}
+	}
+	return nil
+}
+
+// fieldNumber returns the numeric value of field in a JSON document and
+// whether the field is set.
+func fieldNumber(doc []byte, field string) (float64, bool, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return 0, false, err
+	}
+
+	raw, ok := m[field]
+	if !ok || string(raw) == "null" {
+		return 0, false, nil
+	}
+
+	var n float64
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return 0, false, fmt.Errorf("field %q is not a number", field)
+	}
+	return n, true, nil
+}
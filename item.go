@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type Item struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status,omitempty"`
+
+	// Fields holds any other document fields so they survive a round trip
+	// through the store.
+	Fields map[string]json.RawMessage `json:"-"`
+}
+
+// itemFields lists the JSON names of the typed Item fields.
+var itemFields = []string{"id", "name", "status"}
+
+func (i Item) MarshalJSON() ([]byte, error) {
+	type plain Item
+	data, err := json.Marshal(plain(i))
+	if err != nil || len(i.Fields) == 0 {
+		return data, err
+	}
+
+	extra := make(map[string]json.RawMessage, len(i.Fields))
+	for k, v := range i.Fields {
+		if !contains(itemFields, k) {
+			extra[k] = v
+		}
+	}
+	if len(extra) == 0 {
+		return data, nil
+	}
+
+	fields, err := json.Marshal(extra)
+	if err != nil {
+		return nil, err
+	}
+
+	// Splice the extra fields into the object after the typed ones.
+	data = append(data[:len(data)-1], ',')
+	return append(data, fields[1:]...), nil
+}
+
+func (i *Item) UnmarshalJSON(data []byte) error {
+	type plain Item
+	if err := json.Unmarshal(data, (*plain)(i)); err != nil {
+		return err
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	for _, k := range itemFields {
+		delete(m, k)
+	}
+
+	i.Fields = nil
+	if len(m) > 0 {
+		i.Fields = m
+	}
+	return nil
+}
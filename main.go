@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	bolt "go.etcd.io/bbolt"
@@ -11,33 +19,163 @@ import (
 
 var db *bolt.DB
 
-type Item struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-}
+// readOnly is set when the database was opened read-only.
+var readOnly bool
+
+var (
+	errItemExists   = errors.New("item already exists")
+	errItemNotFound = errors.New("item not found")
+)
 
 func main() {
+	stateMachinesPath := flag.String("state-machines", "", "JSON file declaring allowed status transitions per bucket")
+	invariantsPath := flag.String("invariants", "", "JSON file declaring invariants checked across records per bucket")
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dbPath := flag.String("db", "items.db", "path of the database file")
+	flag.BoolVar(&readOnly, "read-only", false, "open the database read-only and reject mutating requests")
+	leader := flag.String("follow", "", "URL of a leader to replicate from; the instance then rejects writes")
+	failoverAfter := flag.Duration("failover-after", 0, "promote this follower to leader once the leader has been unhealthy this long; 0 disables failover")
+	advertise := flag.String("advertise", "", "URL other instances and clients reach this instance at")
+	registerWith := flag.String("register", "", "service discovery to register with, as consul://host:port or etcd://host:port")
+	instanceID := flag.String("instance-id", "", "ID to register this instance under; defaults to the host and port of the advertised URL")
+	leaderRecordPath := flag.String("leader-record", "", "service-discovery file naming the current leader, rewritten on promotion")
+	flag.DurationVar(&consistencyWait, "consistency-wait", consistencyWait, "how long a follower waits to catch up with a read's min-seq hint before proxying it to the leader")
+	mirrorPath := flag.String("mirror", "", "path on a standby disk to keep a copy of the database at")
+	mirrorInterval := flag.Duration("mirror-interval", 10*time.Second, "how often the standby mirror is refreshed when data changed")
+	probeInterval := flag.Duration("probe-interval", 5*time.Second, "how often the cached health probe is refreshed")
+	pollInterval := flag.Duration("poll-interval", time.Second, "how often a follower polls the leader for changes when idle")
+	trashRetention := flag.Duration("trash-retention", 7*24*time.Hour, "how long deleted items are kept in the trash before being purged")
+	flag.Var(compressFlag{}, "compress", "gzip values larger than a threshold in a bucket, as bucket:bytes[,bucket:bytes...]")
+	keysPath := flag.String("keys-file", "", "JSON file with AES keys to encrypt values with; ITEMS_ENCRYPTION_KEY is used if unset")
+	flag.Parse()
+
+	if *advertise == "" {
+		*advertise = "http://localhost" + *addr
+	}
+	if *instanceID == "" {
+		u, err := url.Parse(*advertise)
+		if err != nil {
+			log.Fatal("Error parsing advertised URL:", err)
+		}
+		*instanceID = u.Host
+	}
+
+	if *stateMachinesPath != "" {
+		if err := loadStateMachines(*stateMachinesPath); err != nil {
+			log.Fatal("Error loading state machines:", err)
+		}
+		log.Println("State machines loaded from", *stateMachinesPath)
+	}
+	if *invariantsPath != "" {
+		if err := loadInvariants(*invariantsPath); err != nil {
+			log.Fatal("Error loading invariants:", err)
+		}
+		log.Println("Invariants loaded from", *invariantsPath)
+	}
+
+	if err := loadKeys(*keysPath); err != nil {
+		log.Fatal("Error loading encryption keys:", err)
+	}
+	if encryptionKeys.current != "" {
+		log.Println("Encrypting values with key", encryptionKeys.current)
+	}
+
+	// Bootstrap a new follower from a snapshot of the leader
+	if *leader != "" {
+		if err := fetchSnapshot(*leader, *dbPath); err != nil {
+			log.Fatal("Error fetching snapshot from leader:", err)
+		}
+	}
+
 	// Open the BoltDB database
 	var err error
-	db, err = bolt.Open("items.db", 0600, nil)
+	db, err = bolt.Open(*dbPath, 0600, &bolt.Options{ReadOnly: readOnly})
 	if err != nil {
 		log.Fatal("Error opening database:", err)
 	}
 	defer db.Close()
 	log.Println("Database opened successfully")
 
-	// Create buckets if not exist
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("items"))
-		return err
-	})
-	if err != nil {
-		log.Fatal("Error creating bucket:", err)
+	if readOnly {
+		log.Println("Running in read-only mode")
+	} else {
+		// Create buckets if not exist
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, name := range []string{"items", "trash", "changes"} {
+				if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal("Error creating bucket:", err)
+		}
+		log.Println("Buckets 'items', 'trash' and 'changes' created successfully")
+	}
+
+	// Publish the instance and its role to service discovery
+	var reg registrar
+	if *registerWith != "" {
+		if reg, err = newRegistrar(*registerWith); err != nil {
+			log.Fatal("Error configuring service discovery:", err)
+		}
+	}
+	announce := func() {
+		if reg == nil {
+			return
+		}
+		info := instanceInfo{ID: *instanceID, Role: currentRole(), Address: *advertise, Healthy: healthy()}
+		if err := reg.Register(info); err != nil {
+			log.Println("Error registering with service discovery:", err)
+			return
+		}
+		log.Println("Registered with service discovery as", info.Role)
+	}
+
+	// Leader duties, started on startup or on promotion of a follower
+	lead := func() {
+		// Purge expired trash in the background
+		go purgeTrash(*trashRetention, min(*trashRetention, time.Hour))
+
+		if *leaderRecordPath != "" {
+			if err := writeLeaderRecord(*leaderRecordPath, *advertise); err != nil {
+				log.Println("Error writing leader record:", err)
+			}
+		}
+	}
+
+	switch {
+	case readOnly:
+	case *leader != "":
+		// Apply the leader's changes in the background; trash is purged
+		// by the leader and replicated
+		if err := setLeader(*leader); err != nil {
+			log.Fatal("Error parsing leader URL:", err)
+		}
+		following.Store(true)
+		go follow(*leader, *pollInterval)
+		log.Println("Following leader at", *leader)
+
+		if *failoverAfter > 0 {
+			go watchLeader(*leader, *failoverAfter, min(*failoverAfter/3, 5*time.Second), func() {
+				lead()
+				announce()
+			})
+		}
+	default:
+		lead()
+	}
+
+	// Mirror to the standby path in the background
+	if *mirrorPath != "" {
+		go mirror(*mirrorPath, *mirrorInterval)
 	}
-	log.Println("Bucket 'items' created successfully")
 
 	// Initialize router
 	router := mux.NewRouter()
+	router.Use(consistency)
+	router.Use(rejectWrites)
 
 	// Define routes
 	router.HandleFunc("/items", getAllItems).Methods("GET")
@@ -45,13 +183,62 @@ func main() {
 	router.HandleFunc("/items", createItem).Methods("POST")
 	router.HandleFunc("/items/{id}", updateItem).Methods("PUT")
 	router.HandleFunc("/items/{id}", deleteItem).Methods("DELETE")
+	router.HandleFunc("/items/{id}/restore", restoreItem).Methods("POST")
+	router.HandleFunc("/trash", getTrash).Methods("GET")
+	router.HandleFunc("/batch", batchWrite).Methods("POST")
+	router.HandleFunc("/tx", transact).Methods("POST")
+	router.HandleFunc("/replication/changes", getChanges).Methods("GET")
+	router.HandleFunc("/replication/snapshot", getSnapshot).Methods("GET")
+	router.HandleFunc("/admin/recode/{bucket}", recode).Methods("POST")
+	router.HandleFunc("/admin/reencrypt", reencrypt).Methods("POST")
+
+	// Serve health checks on a minimal chain in front of the API router
+	probe()
+	go runProbes(*probeInterval)
+	root := http.NewServeMux()
+	root.Handle("/healthz", healthHandler())
+	root.Handle("/", router)
+	announce()
+
+	// Deregister and drain requests on shutdown
+	srv := &http.Server{Addr: *addr, Handler: root}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+
+		if reg != nil {
+			if err := reg.Deregister(); err != nil {
+				log.Println("Error deregistering from service discovery:", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Error draining requests:", err)
+		}
+	}()
 
 	// Start server
-	log.Println("Server started at :8080")
-	log.Fatal(http.ListenAndServe(":8080", router))
+	log.Println("Server started at", *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// ListenAndServe returns as soon as Shutdown starts; wait for the
+	// in-flight requests before the database is closed
+	<-drained
+	log.Println("Server stopped")
 }
 
 func getAllItems(w http.ResponseWriter, r *http.Request) {
+	if wantsNDJSON(r) {
+		streamItems(w, r)
+		return
+	}
+
 	var items []Item
 
 	err := db.View(func(tx *bolt.Tx) error {
@@ -61,6 +248,11 @@ func getAllItems(w http.ResponseWriter, r *http.Request) {
 		}
 
 		return b.ForEach(func(k, v []byte) error {
+			v, err := decodeValue(v)
+			if err != nil {
+				return err
+			}
+
 			var item Item
 			if err := json.Unmarshal(v, &item); err != nil {
 				return err
@@ -92,10 +284,12 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 			return nil
 		}
 
-		v = b.Get([]byte(id))
+		var err error
+		v, err = getValue(b, []byte(id))
+		if err != nil {
+			return err
+		}
 		if v == nil {
-			http.NotFound(w, r)
-			log.Println("Item not found for ID:", id)
 			return nil
 		}
 
@@ -106,6 +300,11 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 		log.Println("Error retrieving item:", err)
 		return
 	}
+	if v == nil {
+		http.NotFound(w, r)
+		log.Println("Item not found for ID:", id)
+		return
+	}
 
 	json.NewEncoder(w).Encode(item)
 	log.Printf("Get item with id %v: %v\n", id, string(v))
@@ -121,9 +320,8 @@ func createItem(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("items"))
-		if b == nil {
-			return nil
+		if tx.Bucket([]byte("items")).Get([]byte(item.ID)) != nil {
+			return errItemExists
 		}
 
 		encoded, err := json.Marshal(item)
@@ -131,8 +329,17 @@ func createItem(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		return b.Put([]byte(item.ID), encoded)
+		return putRecord(tx, "items", []byte(item.ID), encoded)
 	})
+	if errors.Is(err, errItemExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		log.Println("Item with ID", item.ID, "already exists")
+		return
+	}
+	if writeRuleError(w, err) {
+		log.Println("Rejected item", item.ID, "creation:", err)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println("Error creating item:", err)
@@ -143,9 +350,12 @@ func createItem(w http.ResponseWriter, r *http.Request) {
 	log.Println("Item with ID", item.ID, "created successfully")
 }
 
+// updateItem replaces an existing item. With ?upsert=true it creates the item
+// if it does not exist instead of responding 404.
 func updateItem(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id := params["id"]
+	upsert := r.URL.Query().Get("upsert") == "true"
 
 	var item Item
 	err := json.NewDecoder(r.Body).Decode(&item)
@@ -156,9 +366,8 @@ func updateItem(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("items"))
-		if b == nil {
-			return nil
+		if !upsert && tx.Bucket([]byte("items")).Get([]byte(id)) == nil {
+			return errItemNotFound
 		}
 
 		encoded, err := json.Marshal(item)
@@ -166,8 +375,17 @@ func updateItem(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		return b.Put([]byte(id), encoded)
+		return putRecord(tx, "items", []byte(id), encoded)
 	})
+	if errors.Is(err, errItemNotFound) {
+		http.NotFound(w, r)
+		log.Println("Item not found for ID:", id)
+		return
+	}
+	if writeRuleError(w, err) {
+		log.Println("Rejected item", id, "update:", err)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println("Error updating item:", err)
@@ -182,13 +400,12 @@ func deleteItem(w http.ResponseWriter, r *http.Request) {
 	id := params["id"]
 
 	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("items"))
-		if b == nil {
-			return nil
-		}
-
-		return b.Delete([]byte(id))
+		return deleteRecord(tx, "items", []byte(id))
 	})
+	if writeRuleError(w, err) {
+		log.Println("Rejected item", id, "deletion:", err)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println("Error deleting item:", err)
@@ -197,3 +414,37 @@ func deleteItem(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("Item with ID", id, "deleted successfully")
 }
+
+// rejectWrites answers every request that could modify the database with
+// 405 Method Not Allowed on instances serving a read-only copy and on
+// followers.
+func rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !readOnly && !following.Load():
+			next.ServeHTTP(w, r)
+		case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			http.Error(w, "server is read-only", http.StatusMethodNotAllowed)
+			log.Println("Rejected", r.Method, r.URL.Path, "in read-only mode")
+		}
+	})
+}
+
+// writeRuleError responds to the errors raised by collection rules checked
+// inside write transactions and reports whether err was one of them.
+func writeRuleError(w http.ResponseWriter, err error) bool {
+	var terr *transitionError
+	var ierr *invariantError
+	switch {
+	case errors.As(err, &terr):
+		writeTransitionError(w, terr)
+	case errors.As(err, &ierr):
+		writeInvariantError(w, ierr)
+	default:
+		return false
+	}
+	return true
+}
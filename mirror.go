@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// mirrorGeneration describes the snapshot currently at the standby path. It
+// is written next to the mirror as <path>.gen once the snapshot is in place.
+type mirrorGeneration struct {
+	Generation uint64    `json:"generation"`
+	Seq        uint64    `json:"seq"`
+	Size       int64     `json:"size"`
+	Time       time.Time `json:"time"`
+}
+
+// mirror keeps a consistent copy of the database at path, refreshed every
+// interval when new changes were committed, for manual failover to a standby
+// disk. It never returns.
+func mirror(path string, interval time.Duration) {
+	gen := readMirrorGeneration(path)
+	for {
+		if seq := currentSeq(); gen.Generation == 0 || seq != gen.Seq {
+			next, err := writeMirror(path, gen.Generation+1)
+			if err != nil {
+				log.Println("Error mirroring database to", path+":", err)
+			} else {
+				gen = next
+				log.Println("Mirrored database to", path, "generation", gen.Generation, "at seq", gen.Seq)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func readMirrorGeneration(path string) mirrorGeneration {
+	var gen mirrorGeneration
+	data, err := os.ReadFile(path + ".gen")
+	if err == nil {
+		json.Unmarshal(data, &gen)
+	}
+	return gen
+}
+
+// writeMirror copies a snapshot to a temporary file and renames it over path,
+// so the standby always holds a complete database.
+func writeMirror(path string, generation uint64) (mirrorGeneration, error) {
+	gen := mirrorGeneration{Generation: generation}
+	tmp := path + ".tmp"
+
+	err := db.View(func(tx *bolt.Tx) error {
+		gen.Seq = lastSeq(tx)
+		gen.Size = tx.Size()
+		return tx.CopyFile(tmp, 0600)
+	})
+	if err != nil {
+		os.Remove(tmp)
+		return gen, err
+	}
+	if err := syncFile(tmp); err != nil {
+		return gen, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return gen, err
+	}
+
+	gen.Time = time.Now().UTC()
+	data, err := json.Marshal(gen)
+	if err != nil {
+		return gen, err
+	}
+	if err := os.WriteFile(path+".gen.tmp", data, 0600); err != nil {
+		return gen, err
+	}
+	return gen, os.Rename(path+".gen.tmp", path+".gen")
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// reservedBuckets are managed by the server itself and cannot be written
+// through the generic batch and transaction APIs.
+var reservedBuckets = []string{"trash", "changes"}
+
+// putRecord writes a record to bucket inside tx, enforcing the state machine
+// and invariants declared for the bucket and logging the change.
+func putRecord(tx *bolt.Tx, bucket string, key, value []byte) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+
+	prev, err := getValue(b, key)
+	if err != nil {
+		return err
+	}
+	if err := checkTransition(bucket, prev, value); err != nil {
+		return err
+	}
+	if err := putLogged(tx, bucket, key, value); err != nil {
+		return err
+	}
+
+	return checkInvariants(bucket, b, key)
+}
+
+// deleteRecord deletes a record from bucket inside tx, moving deleted items to
+// the trash, enforcing the bucket's invariants and logging the change.
+func deleteRecord(tx *bolt.Tx, bucket string, key []byte) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	if bucket == "items" {
+		if err := moveToTrash(tx, b, key); err != nil {
+			return err
+		}
+	}
+	if err := deleteLogged(tx, bucket, key); err != nil {
+		return err
+	}
+
+	return checkInvariants(bucket, b, key)
+}
+
+func checkBucketName(bucket string) error {
+	if bucket == "" {
+		return fmt.Errorf("bucket name is required")
+	}
+	if contains(reservedBuckets, bucket) {
+		return fmt.Errorf("bucket %q is reserved", bucket)
+	}
+	return nil
+}
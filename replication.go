@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Change is one committed mutation as recorded in the "changes" bucket, keyed
+// by its big-endian sequence number.
+type Change struct {
+	Seq    uint64    `json:"seq"`
+	Op     string    `json:"op"`
+	Bucket string    `json:"bucket"`
+	Key    string    `json:"key"`
+	Value  []byte    `json:"value,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// following is set while the instance replicates from a leader and cleared
+// when it is promoted.
+var following atomic.Bool
+
+// replicationClient is used for requests to the leader, so a dead leader
+// behind a half-open connection can't stall a follower forever.
+var replicationClient = &http.Client{Timeout: 30 * time.Second}
+
+// snapshotIdleTimeout aborts a snapshot download that makes no progress for
+// this long. The download as a whole is not bounded since snapshots can be
+// large.
+const snapshotIdleTimeout = 30 * time.Second
+
+var errPromoted = errors.New("promoted to leader")
+
+// maxChangesPerPage bounds the number of changes returned by one request to
+// /replication/changes.
+const maxChangesPerPage = 1000
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// putLogged writes key to bucket and records the write in the change log, in
+// the same transaction. Every mutation of replicated data goes through it or
+// deleteLogged.
+// The value is encoded for storage first, and the change log records the
+// stored form.
+func putLogged(tx *bolt.Tx, bucket string, key, value []byte) error {
+	stored, err := encodeValue(bucket, value)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(bucket)).Put(key, stored); err != nil {
+		return err
+	}
+	return appendChange(tx, &Change{Op: opPut, Bucket: bucket, Key: string(key), Value: stored})
+}
+
+// deleteLogged deletes key from bucket and records the deletion in the change
+// log, in the same transaction.
+func deleteLogged(tx *bolt.Tx, bucket string, key []byte) error {
+	if err := tx.Bucket([]byte(bucket)).Delete(key); err != nil {
+		return err
+	}
+	return appendChange(tx, &Change{Op: opDelete, Bucket: bucket, Key: string(key)})
+}
+
+func appendChange(tx *bolt.Tx, c *Change) error {
+	b := tx.Bucket([]byte("changes"))
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	c.Seq = seq
+	c.Time = time.Now().UTC()
+
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return b.Put(itob(seq), encoded)
+}
+
+// lastSeq returns the sequence number of the newest change in the log.
+func lastSeq(tx *bolt.Tx) uint64 {
+	b := tx.Bucket([]byte("changes"))
+	if b == nil {
+		return 0
+	}
+
+	k, _ := b.Cursor().Last()
+	if k == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(k)
+}
+
+func getChanges(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes := []Change{}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("changes"))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(itob(since + 1)); k != nil && len(changes) < maxChangesPerPage; k, v = c.Next() {
+			var change Change
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println("Error retrieving changes:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// getSnapshot streams a consistent copy of the whole database file, used by
+// followers for their initial full sync.
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	err := db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		log.Println("Error streaming snapshot:", err)
+		return
+	}
+
+	log.Println("Snapshot sent to", r.RemoteAddr)
+}
+
+// fetchSnapshot downloads the leader's database into path, unless a database
+// already exists there.
+func fetchSnapshot(leader, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := time.AfterFunc(snapshotIdleTimeout, cancel)
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, leader+"/replication/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader returned %s", resp.Status)
+	}
+
+	tmp := path + ".sync"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, &progressReader{r: resp.Body, idle: idle}); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// progressReader pushes back an idle timer whenever data arrives.
+type progressReader struct {
+	r    io.Reader
+	idle *time.Timer
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.idle.Reset(snapshotIdleTimeout)
+	}
+	return n, err
+}
+
+// follow polls the leader for new changes and applies them locally until the
+// instance is promoted.
+func follow(leader string, interval time.Duration) {
+	for following.Load() {
+		n, err := pullChanges(leader)
+		if err != nil {
+			log.Println("Error pulling changes from leader:", err)
+		}
+		if n == 0 {
+			time.Sleep(interval)
+		}
+	}
+}
+
+func pullChanges(leader string) (int, error) {
+	var since uint64
+	db.View(func(tx *bolt.Tx) error {
+		since = lastSeq(tx)
+		return nil
+	})
+
+	resp, err := replicationClient.Get(fmt.Sprintf("%s/replication/changes?since=%d", leader, since))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("leader returned %s", resp.Status)
+	}
+
+	var changes []Change
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		return 0, err
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	if changes[0].Seq != since+1 {
+		return 0, fmt.Errorf("change log gap: applied up to %d but leader continues at %d; resync from a snapshot", since, changes[0].Seq)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// A promotion may have happened while the changes were in
+		// flight; applying them now would reuse sequence numbers the
+		// new leader has handed out already. Checked inside the write
+		// transaction, which serializes with the new leader's writes.
+		if !following.Load() {
+			return errPromoted
+		}
+		for i := range changes {
+			if err := applyChange(tx, &changes[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errPromoted) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(changes), nil
+}
+
+// applyChange replays a change received from the leader and copies it into
+// the local change log under the same sequence number.
+func applyChange(tx *bolt.Tx, c *Change) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(c.Bucket))
+	if err != nil {
+		return err
+	}
+
+	switch c.Op {
+	case opPut:
+		err = b.Put([]byte(c.Key), c.Value)
+	case opDelete:
+		err = b.Delete([]byte(c.Key))
+	default:
+		err = fmt.Errorf("unknown change op %q", c.Op)
+	}
+	if err != nil {
+		return err
+	}
+
+	changes := tx.Bucket([]byte("changes"))
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := changes.Put(itob(c.Seq), encoded); err != nil {
+		return err
+	}
+	return changes.SetSequence(c.Seq)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// StateMachine declares the allowed values of a designated field in a bucket
+// and which values it may move to on the next write.
+type StateMachine struct {
+	Field       string              `json:"field"`
+	Initial     []string            `json:"initial"`
+	Transitions map[string][]string `json:"transitions"`
+}
+
+// stateMachines holds the declared state machines keyed by bucket name.
+var stateMachines = map[string]*StateMachine{}
+
+func registerStateMachine(bucket string, sm *StateMachine) {
+	stateMachines[bucket] = sm
+}
+
+// loadStateMachines reads a JSON file mapping bucket names to state machines.
+func loadStateMachines(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var machines map[string]*StateMachine
+	if err := json.Unmarshal(data, &machines); err != nil {
+		return err
+	}
+
+	for bucket, sm := range machines {
+		if sm.Field == "" {
+			return fmt.Errorf("state machine for bucket %q has no field", bucket)
+		}
+		registerStateMachine(bucket, sm)
+	}
+	return nil
+}
+
+type transitionError struct {
+	Field   string   `json:"field"`
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to"`
+	Allowed []string `json:"allowed"`
+}
+
+func (e *transitionError) Error() string {
+	if e.From == "" {
+		return fmt.Sprintf("invalid initial %s %q", e.Field, e.To)
+	}
+	return fmt.Sprintf("invalid %s transition from %q to %q", e.Field, e.From, e.To)
+}
+
+// checkTransition validates the write of next over prev (nil when the key
+// does not exist yet) against the state machine declared for bucket, if any.
+// It must be called inside the write transaction so prev is current.
+func checkTransition(bucket string, prev, next []byte) error {
+	sm, ok := stateMachines[bucket]
+	if !ok {
+		return nil
+	}
+
+	to, err := fieldString(next, sm.Field)
+	if err != nil {
+		return err
+	}
+
+	if prev == nil {
+		allowed := sm.Initial
+		if len(allowed) == 0 {
+			allowed = sm.states()
+		}
+		if !contains(allowed, to) {
+			return &transitionError{Field: sm.Field, To: to, Allowed: allowed}
+		}
+		return nil
+	}
+
+	from, err := fieldString(prev, sm.Field)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+
+	allowed := sm.Transitions[from]
+	if !contains(allowed, to) {
+		return &transitionError{Field: sm.Field, From: from, To: to, Allowed: allowed}
+	}
+	return nil
+}
+
+func (sm *StateMachine) states() []string {
+	states := make([]string, 0, len(sm.Transitions))
+	for s := range sm.Transitions {
+		states = append(states, s)
+	}
+	sort.Strings(states)
+	return states
+}
+
+// fieldString returns the string value of field in a JSON document, or an
+// empty string if the field is not set.
+func fieldString(doc []byte, field string) (string, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return "", err
+	}
+
+	raw, ok := m[field]
+	if !ok {
+		return "", nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("field %q is not a string", field)
+	}
+	return s, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func writeTransitionError(w http.ResponseWriter, terr *transitionError) {
+	if terr.Allowed == nil {
+		terr.Allowed = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*transitionError
+	}{terr.Error(), terr})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const ndjsonType = "application/x-ndjson"
+
+// ndjsonFlushEvery is how many items are written between flushes of a
+// streamed listing.
+const ndjsonFlushEvery = 100
+
+// wantsNDJSON reports whether the client asked for a newline-delimited JSON
+// listing.
+func wantsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mt == ndjsonType {
+			return true
+		}
+	}
+	return false
+}
+
+// streamItems writes every item as one JSON line straight from the cursor,
+// flushing periodically, so memory stays flat regardless of bucket size.
+func streamItems(w http.ResponseWriter, r *http.Request) {
+	// Send the headers before the read transaction begins; middleware
+	// setting them may open transactions of its own.
+	w.Header().Set("Content-Type", ndjsonType)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	n := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("items"))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			v, err := decodeValue(v)
+			if err != nil {
+				return err
+			}
+
+			var item Item
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if err := enc.Encode(item); err != nil {
+				return err
+			}
+
+			n++
+			if flusher != nil && n%ndjsonFlushEvery == 0 {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// The status line is gone once streaming started, so the error
+		// can only be logged and the response cut short.
+		log.Println("Error streaming items:", err)
+		return
+	}
+
+	log.Println("Streamed", n, "items successfully.")
+}
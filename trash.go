@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// trashEntry is what a deleted item is kept as in the "trash" bucket until it
+// is restored or purged.
+type trashEntry struct {
+	ID        string          `json:"id"`
+	DeletedAt time.Time       `json:"deletedAt"`
+	Item      json.RawMessage `json:"item"`
+}
+
+var errRestoreConflict = errors.New("an item with this ID already exists")
+
+// moveToTrash stores the current value of key in the trash bucket. It is a
+// no-op if the key does not exist.
+func moveToTrash(tx *bolt.Tx, b *bolt.Bucket, key []byte) error {
+	v, err := getValue(b, key)
+	if err != nil || v == nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(trashEntry{
+		ID:        string(key),
+		DeletedAt: time.Now().UTC(),
+		Item:      v,
+	})
+	if err != nil {
+		return err
+	}
+
+	return putLogged(tx, "trash", key, encoded)
+}
+
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	entries := []trashEntry{}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("trash"))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			v, err := decodeValue(v)
+			if err != nil {
+				return err
+			}
+
+			var entry trashEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println("Error retrieving trash:", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(entries)
+	log.Println("Get trash successfully.")
+}
+
+func restoreItem(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	found := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		trash := tx.Bucket([]byte("trash"))
+		v, err := getValue(trash, []byte(id))
+		if err != nil || v == nil {
+			return err
+		}
+		found = true
+
+		var entry trashEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte("items"))
+		if b.Get([]byte(id)) != nil {
+			return errRestoreConflict
+		}
+		if err := putLogged(tx, "items", []byte(id), entry.Item); err != nil {
+			return err
+		}
+		if err := deleteLogged(tx, "trash", []byte(id)); err != nil {
+			return err
+		}
+
+		return checkInvariants("items", b, []byte(id))
+	})
+	if errors.Is(err, errRestoreConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		log.Println("Rejected restore of item", id+":", err)
+		return
+	}
+	if writeRuleError(w, err) {
+		log.Println("Rejected restore of item", id+":", err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println("Error restoring item:", err)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		log.Println("Trashed item not found for ID:", id)
+		return
+	}
+
+	log.Println("Item with ID", id, "restored successfully")
+}
+
+// purgeTrash periodically removes trashed items deleted more than retention
+// ago. It never returns.
+func purgeTrash(retention, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := purgeTrashOnce(time.Now().Add(-retention))
+		if err != nil {
+			log.Println("Error purging trash:", err)
+			continue
+		}
+		if n > 0 {
+			log.Println("Purged", n, "items from trash")
+		}
+	}
+}
+
+func purgeTrashOnce(cutoff time.Time) (int, error) {
+	var n int
+	err := db.Update(func(tx *bolt.Tx) error {
+		trash := tx.Bucket([]byte("trash"))
+
+		var expired [][]byte
+		err := trash.ForEach(func(k, v []byte) error {
+			v, err := decodeValue(v)
+			if err != nil {
+				return err
+			}
+
+			var entry trashEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.DeletedAt.Before(cutoff) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := deleteLogged(tx, "trash", k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Result statuses reported by the transaction endpoint.
+const (
+	resultRolledBack = "rolled_back"
+	resultNotRun     = "not_run"
+)
+
+// TxResult reports the outcome of one operation of a transaction.
+type TxResult struct {
+	Index   int    `json:"index"`
+	Op      string `json:"op"`
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Status  string `json:"status"`
+	Existed bool   `json:"existed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runTx applies ops atomically in a single write transaction. If any
+// operation fails, the whole transaction is rolled back and the failing
+// operation is reported along with its error.
+func runTx(ops []BatchOp) ([]TxResult, error) {
+	var results []TxResult
+	err := db.Update(func(tx *bolt.Tx) error {
+		results = make([]TxResult, len(ops))
+		for i, op := range ops {
+			results[i] = TxResult{Index: i, Op: op.Op, Bucket: op.Bucket, Key: op.Key, Status: resultNotRun}
+		}
+
+		for i := range ops {
+			prev, err := ops[i].apply(tx)
+			if err != nil {
+				results[i].Status = stepFailed
+				results[i].Error = err.Error()
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+			results[i].Status = stepApplied
+			results[i].Existed = prev != nil
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range results {
+			if results[i].Status == stepApplied {
+				results[i].Status = resultRolledBack
+			}
+		}
+	}
+	return results, err
+}
+
+// transact applies a list of operations across buckets atomically: either
+// all of them are committed or none is.
+func transact(w http.ResponseWriter, r *http.Request) {
+	var ops []BatchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println("Error decoding JSON:", err)
+		return
+	}
+	for i := range ops {
+		if err := ops[i].validate(); err != nil {
+			http.Error(w, fmt.Sprintf("operation %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := runTx(ops)
+
+	var terr *transitionError
+	var ierr *invariantError
+	status := http.StatusOK
+	switch {
+	case err == nil:
+	case errors.As(err, &terr):
+		status = http.StatusConflict
+	case errors.As(err, &ierr):
+		status = http.StatusUnprocessableEntity
+	default:
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Committed bool       `json:"committed"`
+		Results   []TxResult `json:"results"`
+	}{err == nil, results})
+
+	if err != nil {
+		log.Println("Transaction of", len(ops), "operations rolled back:", err)
+		return
+	}
+	log.Println("Transaction of", len(ops), "operations committed")
+}